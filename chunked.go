@@ -0,0 +1,361 @@
+package nimbus
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// chunkUploadTTL bounds how long a resumable upload may sit incomplete
+// before the chunk janitor reclaims its staged file and upload ID. Clients
+// that abandon an upload (or never retry after a dropped connection) would
+// otherwise leak both forever.
+const chunkUploadTTL = 24 * time.Hour
+
+// chunkUpload tracks the staging state of a single in-progress resumable
+// upload, keyed by an upload ID handed out on its first request.
+type chunkUpload struct {
+	mu    sync.Mutex
+	ext   string
+	total int64
+	// ranges holds the byte ranges actually written to path so far, sorted
+	// and merged so no two elements overlap or touch. Tracking coverage
+	// this way (rather than a single high-water mark) means two chunks
+	// landing out of order, or for disjoint ranges, can't be mistaken for
+	// a complete file with an unwritten gap in the middle.
+	ranges       []byteRange
+	path         string
+	lastActivity time.Time
+}
+
+// byteRange is an inclusive byte range [start, end] of a chunked upload's
+// staged file that has been confirmed written.
+type byteRange struct {
+	start, end int64
+}
+
+// insertRange inserts [start, end] into ranges - sorted, non-overlapping and
+// non-adjacent - merging it with any range it overlaps or touches, and
+// returns the updated list.
+func insertRange(ranges []byteRange, start, end int64) []byteRange {
+	merged := byteRange{start, end}
+	out := make([]byteRange, 0, len(ranges)+1)
+	inserted := false
+	for _, r := range ranges {
+		switch {
+		case r.end+1 < merged.start:
+			out = append(out, r)
+		case merged.end+1 < r.start:
+			if !inserted {
+				out = append(out, merged)
+				inserted = true
+			}
+			out = append(out, r)
+		default:
+			if r.start < merged.start {
+				merged.start = r.start
+			}
+			if r.end > merged.end {
+				merged.end = r.end
+			}
+		}
+	}
+	if !inserted {
+		out = append(out, merged)
+	}
+	return out
+}
+
+// coveredPrefix returns how many bytes starting at offset 0 are covered by
+// ranges without a gap.
+func coveredPrefix(ranges []byteRange) int64 {
+	if len(ranges) == 0 || ranges[0].start != 0 {
+		return 0
+	}
+	return ranges[0].end + 1
+}
+
+// fullyCovers reports whether ranges covers the whole of [0, total) with no
+// gaps.
+func fullyCovers(ranges []byteRange, total int64) bool {
+	return len(ranges) == 1 && ranges[0].start == 0 && ranges[0].end == total-1
+}
+
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// parseContentRange parses a `Content-Range: bytes start-end/total` header
+// value, as sent by resumable upload clients.
+func parseContentRange(hdr string) (start, end, total int64, err error) {
+	if _, err = fmt.Sscanf(hdr, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range: %s", hdr)
+	}
+	if start < 0 || end < start || total <= end {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range: %s", hdr)
+	}
+	return start, end, total, nil
+}
+
+func (n *NimbusHTTPFormImpl) ensureChunkDir() (string, error) {
+	n.chunkMu.Lock()
+	if n.chunkDir == "" {
+		n.chunkDir = filepath.Join(os.TempDir(), "nimbus-chunks")
+	}
+	dir := n.chunkDir
+	n.chunkMu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// UploadChunk implements resumable uploads for large files. Clients PUT (or
+// POST) successive chunks of a file, each carrying a `Content-Range: bytes
+// start-end/total` header. The first chunk must also carry a
+// `Content-Disposition` header naming the file, so its extension can be
+// validated; the response returns the assigned upload ID in the `Upload-Id`
+// header, which subsequent chunk requests must echo back. A bare HEAD
+// request carrying `Upload-Id` reports how much of the upload has been
+// received via a `Range: bytes=0-N` response header, so clients can resume
+// after a dropped connection. Chunks may arrive out of order or for disjoint
+// ranges; once they cover [0, total) with no gaps, the staged file is
+// promoted into storage via the normal upload flow and its stored name is
+// returned as JSON.
+func (n *NimbusHTTPFormImpl) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		n.reportChunkProgress(w, r)
+		return
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.Header.Get("Upload-Id")
+	var up *chunkUpload
+	if id == "" {
+		if id, up, err = n.beginChunkUpload(r, total); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		n.chunkMu.Lock()
+		up = n.chunks[id]
+		n.chunkMu.Unlock()
+		if up == nil {
+			http.Error(w, "unknown upload id", http.StatusNotFound)
+			return
+		}
+	}
+
+	received, complete, err := writeChunk(up, start, end, r.Body)
+	if err != nil {
+		if isShortChunk(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Id", id)
+	w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	if !complete {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	n.promoteChunkUpload(w, id, up)
+}
+
+// beginChunkUpload validates the Content-Disposition header of the first
+// chunk of a new upload, stages a file for it and registers it under a
+// freshly generated upload ID.
+func (n *NimbusHTTPFormImpl) beginChunkUpload(r *http.Request, total int64) (string, *chunkUpload, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+	if err != nil {
+		return "", nil, fmt.Errorf("missing or invalid Content-Disposition")
+	}
+	ext := filepath.Ext(params["filename"])
+	if err := n.isExtAllowed(ext); err != nil {
+		return "", nil, err
+	}
+
+	dir, err := n.ensureChunkDir()
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := ioutil.TempFile(dir, fmt.Sprintf("*%s", ext))
+	if err != nil {
+		return "", nil, err
+	}
+	f.Close()
+
+	id, err := newUploadID()
+	if err != nil {
+		return "", nil, err
+	}
+	up := &chunkUpload{ext: ext, total: total, path: f.Name(), lastActivity: time.Now()}
+	n.chunkMu.Lock()
+	n.chunks[id] = up
+	n.chunkMu.Unlock()
+	return id, up, nil
+}
+
+// shortChunkError is returned by writeChunk when the body delivered a
+// different number of bytes (fewer or more) than its own Content-Range
+// declared. Callers use it to respond with 400 Bad Request rather than a
+// generic error.
+type shortChunkError struct {
+	start, end, got int64
+}
+
+func (e *shortChunkError) Error() string {
+	return fmt.Sprintf("chunk length mismatch: declared %d-%d but received %d bytes", e.start, e.end, e.got)
+}
+
+// isShortChunk reports whether err was returned because a chunk's body
+// delivered a different number of bytes than its Content-Range declared.
+func isShortChunk(err error) bool {
+	_, ok := err.(*shortChunkError)
+	return ok
+}
+
+// writeChunk appends the bytes read from r at offset start in up's staging
+// file, records [start, end] as covered and returns the number of bytes
+// covered by a gap-free prefix starting at 0, along with whether the upload
+// is now fully covered end-to-end.
+func writeChunk(up *chunkUpload, start, end int64, r io.Reader) (received int64, complete bool, err error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	f, err := os.OpenFile(up.path, os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return 0, false, err
+	}
+	want := end - start + 1
+	got, err := io.Copy(f, r)
+	if err != nil {
+		return 0, false, err
+	}
+	if got != want {
+		return 0, false, &shortChunkError{start: start, end: end, got: got}
+	}
+	up.lastActivity = time.Now()
+	up.ranges = insertRange(up.ranges, start, end)
+	return coveredPrefix(up.ranges), fullyCovers(up.ranges, up.total), nil
+}
+
+func (n *NimbusHTTPFormImpl) reportChunkProgress(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get("Upload-Id")
+	if id == "" {
+		http.Error(w, "missing Upload-Id", http.StatusBadRequest)
+		return
+	}
+	n.chunkMu.Lock()
+	up := n.chunks[id]
+	n.chunkMu.Unlock()
+	if up == nil {
+		http.Error(w, "unknown upload id", http.StatusNotFound)
+		return
+	}
+	up.mu.Lock()
+	received := coveredPrefix(up.ranges)
+	up.mu.Unlock()
+	w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// promoteChunkUpload runs the completed staged file through the normal
+// extension/MIME validation and storage flow, then discards the chunk state.
+func (n *NimbusHTTPFormImpl) promoteChunkUpload(w http.ResponseWriter, id string, up *chunkUpload) {
+	n.chunkMu.Lock()
+	delete(n.chunks, id)
+	n.chunkMu.Unlock()
+
+	f, err := os.Open(up.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := n.storeUpload(up.ext, f)
+	f.Close()
+	os.Remove(up.path)
+	if err != nil {
+		if isMIMEMismatch(err) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	n.mu.Lock()
+	n.mimeCache[info.Name] = nil
+	n.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Stored string `json:"stored"`
+	}{info.Name})
+}
+
+// runChunkJanitor periodically sweeps n.chunks for uploads abandoned for
+// longer than chunkUploadTTL, until stop is closed.
+func (n *NimbusHTTPFormImpl) runChunkJanitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(chunkUploadTTL / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n.sweepStaleChunks()
+		}
+	}
+}
+
+// sweepStaleChunks deletes the staged file and upload-ID entry of every
+// chunk upload that hasn't received a chunk in over chunkUploadTTL.
+func (n *NimbusHTTPFormImpl) sweepStaleChunks() {
+	cutoff := time.Now().Add(-chunkUploadTTL)
+	var stalePaths []string
+	n.chunkMu.Lock()
+	for id, up := range n.chunks {
+		up.mu.Lock()
+		stale := up.lastActivity.Before(cutoff)
+		up.mu.Unlock()
+		if stale {
+			stalePaths = append(stalePaths, up.path)
+			delete(n.chunks, id)
+		}
+	}
+	n.chunkMu.Unlock()
+
+	for _, path := range stalePaths {
+		_ = os.Remove(path)
+	}
+}
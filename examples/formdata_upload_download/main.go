@@ -12,11 +12,17 @@ import (
 
 func main() {
 	// HTTP Form file server, with 10mb max file size & 256 byte copy buffer,
-	// allowing image files with and not files without extensions.
+	// allowing image files with and not files without extensions. Files are
+	// persisted to local disk; swap in nimbus.NewMemStorage or
+	// nimbus.NewS3Storage to use a different backend.
+	storage, err := nimbus.NewLocalStorage("examples/formdata_upload_download/.nimbus_tmp")
+	if err != nil {
+		log.Fatalf("failed to initialize storage: %s", err.Error())
+	}
 	impl, _ := nimbus.NewHTTPFormImpl("_file_",
 		nimbus.Mb10,
 		nimbus.DefaultTransferBuffSize,
-		"examples/formdata_upload_download/.nimbus_tmp",
+		storage,
 		nimbus.ExtImg, false)
 	// handle ctrl+c and cleanup since defered cleanup call won't be run
 	c := make(chan os.Signal, 1)
@@ -47,6 +53,7 @@ func Configure(n nimbus.NimbusHTTP, m *mux.Router) {
 	m.HandleFunc("/upload", n.Upload)
 	m.HandleFunc("/download", n.Download)
 	m.HandleFunc("/upload-many", n.UploadMany)
+	m.HandleFunc("/upload-chunk", n.UploadChunk)
 	m.HandleFunc("/download-many", n.DownloadMany)
 	m.HandleFunc("/delete", n.Delete)
 }
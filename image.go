@@ -0,0 +1,241 @@
+package nimbus
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// imageContentTypes maps the target formats Download's image transforms can
+// encode to onto their Content-Type. Notably absent is webp: encoding it
+// requires a cgo-backed library, and WithImageProcessor must stay usable in
+// CGO_ENABLED=0 builds.
+var imageContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+}
+
+// ImageProcessorOptions configures the on-demand image transforms Download
+// performs when enabled via WithImageProcessor.
+type ImageProcessorOptions struct {
+	// MaxWidth and MaxHeight cap the w/h query parameters a caller may
+	// request, to bound the cost of a single transform. Zero means
+	// unbounded.
+	MaxWidth, MaxHeight int
+	// JPEGQuality is passed to image/jpeg when encoding to that format.
+	// Defaults to 85 if unset.
+	JPEGQuality int
+}
+
+func (o ImageProcessorOptions) jpegQuality() int {
+	if o.JPEGQuality <= 0 {
+		return 85
+	}
+	return o.JPEGQuality
+}
+
+// imageProcessor holds the resolved configuration for WithImageProcessor.
+type imageProcessor struct {
+	opts ImageProcessorOptions
+}
+
+// WithImageProcessor turns Download's `?w=&h=&fit=&fmt=` query parameters
+// into a resize-and-reencode transform, applied only to files whose
+// extension is in ExtImg. Disabled by default.
+func WithImageProcessor(opts ImageProcessorOptions) Option {
+	return func(n *NimbusHTTPFormImpl) {
+		n.imageProcessor = &imageProcessor{opts: opts}
+	}
+}
+
+// isImageExt reports whether ext is one of the extensions in ExtImg.
+func isImageExt(ext string) bool {
+	for _, e := range ExtImg {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// imageTransform describes a single Download image transform, parsed from
+// query parameters.
+type imageTransform struct {
+	width, height int
+	fit           string // "cover" (default, crop-to-fill), "contain" (scale-to-fit, letterboxed), or anything else to stretch-to-fill
+	format        string // target extension, e.g. ".png"; "" keeps the original
+}
+
+// parseImageTransform parses w/h/fit/fmt query parameters. ok is false if
+// none of w, h or fmt was present, meaning no transform was requested; fit
+// on its own does not request one. It does not
+// enforce MaxWidth/MaxHeight: w/h default to the source image's own
+// dimensions when omitted, which aren't known until apply decodes it, so
+// that bound is enforced there instead.
+func parseImageTransform(q url.Values) (tr *imageTransform, ok bool, err error) {
+	w, h, fit, fmtParam := q.Get("w"), q.Get("h"), q.Get("fit"), q.Get("fmt")
+	if w == "" && h == "" && fmtParam == "" {
+		return nil, false, nil
+	}
+	tr = &imageTransform{fit: "cover"}
+	if fit != "" {
+		tr.fit = fit
+	}
+	if fmtParam != "" {
+		tr.format = "." + strings.ToLower(fmtParam)
+		if _, ok := imageContentTypes[tr.format]; !ok {
+			return nil, true, fmt.Errorf("unsupported target format: %s", fmtParam)
+		}
+	}
+	if w != "" {
+		if tr.width, err = strconv.Atoi(w); err != nil || tr.width <= 0 {
+			return nil, true, fmt.Errorf("invalid width: %s", w)
+		}
+	}
+	if h != "" {
+		if tr.height, err = strconv.Atoi(h); err != nil || tr.height <= 0 {
+			return nil, true, fmt.Errorf("invalid height: %s", h)
+		}
+	}
+	return tr, true, nil
+}
+
+// targetExt returns the extension the transformed image will be encoded
+// with: the requested format, or name's own extension if none was given.
+func (tr *imageTransform) targetExt(name string) string {
+	if tr.format != "" {
+		return tr.format
+	}
+	return filepath.Ext(name)
+}
+
+// cacheKey derives a deterministic name for the cached result of applying
+// tr to name, so repeat requests for the same transform are served from
+// storage instead of being recomputed.
+func (tr *imageTransform) cacheKey(name string) string {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	return fmt.Sprintf("%s.%dx%d-%s%s", base, tr.width, tr.height, tr.fit, tr.targetExt(name))
+}
+
+// dimensionError is returned by apply when the resolved width or height of a
+// transform (after substituting the source image's own dimensions for any
+// omitted w/h) exceeds MaxWidth/MaxHeight. Callers use it to respond with
+// 400 Bad Request rather than a generic error.
+type dimensionError struct {
+	dim         string
+	got, maxVal int
+}
+
+func (e *dimensionError) Error() string {
+	return fmt.Sprintf("%s %d exceeds maximum of %d", e.dim, e.got, e.maxVal)
+}
+
+// isDimensionError reports whether err was returned because a resolved
+// transform dimension exceeded MaxWidth/MaxHeight.
+func isDimensionError(err error) bool {
+	_, ok := err.(*dimensionError)
+	return ok
+}
+
+// apply decodes src, resizes it per tr and re-encodes it to tr's target
+// format.
+func (p *imageProcessor) apply(tr *imageTransform, name string, src []byte) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %s", err.Error())
+	}
+
+	width, height := tr.width, tr.height
+	srcBounds := img.Bounds()
+	if width == 0 {
+		width = srcBounds.Dx()
+	}
+	if height == 0 {
+		height = srcBounds.Dy()
+	}
+	// MaxWidth/MaxHeight must be checked against the resolved dimensions,
+	// not tr.width/tr.height: those are 0 (and so pass any check) whenever
+	// w/h were omitted from the request.
+	if p.opts.MaxWidth > 0 && width > p.opts.MaxWidth {
+		return nil, &dimensionError{dim: "width", got: width, maxVal: p.opts.MaxWidth}
+	}
+	if p.opts.MaxHeight > 0 && height > p.opts.MaxHeight {
+		return nil, &dimensionError{dim: "height", got: height, maxVal: p.opts.MaxHeight}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	switch tr.fit {
+	case "cover":
+		srcRect := coverCrop(srcBounds, width, height)
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, srcRect, draw.Over, nil)
+	case "contain":
+		dstRect := containRect(srcBounds, width, height)
+		draw.CatmullRom.Scale(dst, dstRect, img, srcBounds, draw.Over, nil)
+	default:
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, srcBounds, draw.Over, nil)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, dst, tr.targetExt(name), p.opts.jpegQuality()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// coverCrop returns the largest centered rectangle within srcBounds whose
+// aspect ratio matches dstW:dstH, for a "cover" fit (crop-to-fill).
+func coverCrop(srcBounds image.Rectangle, dstW, dstH int) image.Rectangle {
+	srcW, srcH := srcBounds.Dx(), srcBounds.Dy()
+	srcAspect := float64(srcW) / float64(srcH)
+	dstAspect := float64(dstW) / float64(dstH)
+
+	if srcAspect > dstAspect {
+		cropW := int(float64(srcH) * dstAspect)
+		x0 := srcBounds.Min.X + (srcW-cropW)/2
+		return image.Rect(x0, srcBounds.Min.Y, x0+cropW, srcBounds.Max.Y)
+	}
+	cropH := int(float64(srcW) / dstAspect)
+	y0 := srcBounds.Min.Y + (srcH-cropH)/2
+	return image.Rect(srcBounds.Min.X, y0, srcBounds.Max.X, y0+cropH)
+}
+
+// containRect returns the largest centered rectangle within a dstW x dstH
+// canvas whose aspect ratio matches srcBounds, for a "contain" fit
+// (scale-to-fit without distortion, letterboxed on the shorter axis).
+func containRect(srcBounds image.Rectangle, dstW, dstH int) image.Rectangle {
+	srcAspect := float64(srcBounds.Dx()) / float64(srcBounds.Dy())
+	dstAspect := float64(dstW) / float64(dstH)
+
+	if srcAspect > dstAspect {
+		h := int(float64(dstW) / srcAspect)
+		y0 := (dstH - h) / 2
+		return image.Rect(0, y0, dstW, y0+h)
+	}
+	w := int(float64(dstH) * srcAspect)
+	x0 := (dstW - w) / 2
+	return image.Rect(x0, 0, x0+w, dstH)
+}
+
+func encodeImage(w *bytes.Buffer, img image.Image, ext string, jpegQuality int) error {
+	switch ext {
+	case ".jpg", ".jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	case ".png":
+		return png.Encode(w, img)
+	case ".gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported target format: %s", ext)
+	}
+}
@@ -0,0 +1,87 @@
+package nimbus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of leading bytes inspected by http.DetectContentType.
+const sniffLen = 512
+
+// DefaultAllowedMIMEs is a reasonable default extension -> MIME-prefix map
+// covering the extension sets defined in this package (ExtImg, ExtComp,
+// ExtTxt). A detected content type is considered a match for an extension
+// if it has the mapped value as a prefix, so e.g. "text/plain; charset=utf-8"
+// matches ".txt" -> "text/plain".
+//
+// ".apng", ".avif" and ".svg" are deliberately absent: net/http's sniffer
+// has no distinct signature for them (APNG sniffs as plain "image/png",
+// and AVIF/SVG have no signature at all, falling through to a generic
+// type), so content-checking them would 415 every legitimate upload of
+// those extensions. ".tar" and ".bz2" from ExtComp are absent as well, as
+// the sniffer has no signature for them either. They're still accepted by
+// the extension allowlist; they're just never content-sniffed against it.
+var DefaultAllowedMIMEs = map[string]string{
+	".gif":   "image/gif",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".jfif":  "image/jpeg",
+	".pjpeg": "image/jpeg",
+	".pjp":   "image/jpeg",
+	".png":   "image/png",
+	".webp":  "image/webp",
+	".bmp":   "image/bmp",
+	".zip":   "application/zip",
+	// net/http's sniffer reports gzip as "application/x-gzip", not
+	// "application/gzip".
+	".gz":  "application/x-gzip",
+	".tgz": "application/x-gzip",
+	".txt": "text/plain",
+}
+
+// mimeMismatchError is returned by sniffMIME when the content-based MIME
+// type of an upload doesn't match its claimed extension. Callers use it to
+// respond with 415 Unsupported Media Type rather than a generic error.
+type mimeMismatchError struct {
+	ext, detected string
+}
+
+func (e *mimeMismatchError) Error() string {
+	return fmt.Sprintf("detected content type %q does not match extension %q", e.detected, e.ext)
+}
+
+// isMIMEMismatch reports whether err was returned because of a failed MIME
+// sniffing check.
+func isMIMEMismatch(err error) bool {
+	_, ok := err.(*mimeMismatchError)
+	return ok
+}
+
+// sniffMIME reads up to the first sniffLen bytes of r to content-sniff its
+// MIME type via http.DetectContentType, cross-checks it against ext using
+// `allowed` (an extension -> MIME-prefix map) and returns a reader which
+// reproduces the full, unconsumed stream of r regardless of how much of it
+// was read while sniffing. If `allowed` has no entry for ext, the content is
+// not checked (the extension allowlist alone governs that case).
+func sniffMIME(ext string, r io.Reader, allowed map[string]string) (io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	wrapped := io.MultiReader(bytes.NewReader(head), r)
+
+	want, ok := allowed[ext]
+	if !ok {
+		return wrapped, nil
+	}
+	detected := http.DetectContentType(head)
+	if !strings.HasPrefix(detected, want) {
+		return wrapped, &mimeMismatchError{ext: ext, detected: detected}
+	}
+	return wrapped, nil
+}
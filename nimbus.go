@@ -8,7 +8,11 @@ import (
 type NimbusHTTP interface {
 	Upload(w http.ResponseWriter, r *http.Request)
 	UploadMany(w http.ResponseWriter, r *http.Request)
+	// UploadChunk handles a single chunk of a resumable upload. See the
+	// NimbusHTTPFormImpl.UploadChunk doc comment for the wire protocol.
+	UploadChunk(w http.ResponseWriter, r *http.Request)
 	Download(w http.ResponseWriter, r *http.Request)
 	DownloadMany(w http.ResponseWriter, r *http.Request)
+	Delete(w http.ResponseWriter, r *http.Request)
 	Cleanup()
 }
@@ -7,12 +7,10 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"mime/multipart"
 	"net/http"
-	"os"
-	"path"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const (
@@ -44,43 +42,116 @@ type NimbusHTTPFormImpl struct {
 	tBuffSize         int64
 	dfk               string
 	mimeCache         map[string][]string
-	tmpDir            string
+	storage           Storage
 	allowedExtensions []string
 	allowNoExt        bool
+	allowedMIMEs      map[string]string
+
+	chunkMu          sync.Mutex
+	chunkDir         string
+	chunks           map[string]*chunkUpload
+	chunkJanitorStop chan struct{}
+
+	fileTTL       time.Duration
+	signingSecret []byte
+	janitorStop   chan struct{}
+
+	imageProcessor *imageProcessor
+}
+
+// Option configures optional behavior on a NimbusHTTPFormImpl at
+// construction time. See WithAllowedMIMEs.
+type Option func(*NimbusHTTPFormImpl)
+
+// WithAllowedMIMEs enables content-based MIME sniffing: uploads are rejected
+// with 415 Unsupported Media Type if the sniffed content type of the file
+// doesn't match its extension according to `allowed`, an extension -> MIME
+// prefix map such as DefaultAllowedMIMEs. Extensions absent from `allowed`
+// are not content-checked, so this can be used to whitelist only a subset of
+// the extensions permitted by `exts` in NewHTTPFormImpl.
+func WithAllowedMIMEs(allowed map[string]string) Option {
+	return func(n *NimbusHTTPFormImpl) {
+		n.allowedMIMEs = allowed
+	}
+}
+
+// WithChunkDir sets the directory in which in-progress resumable uploads
+// (see UploadChunk) are staged while they're incomplete. If unset, it
+// defaults to a "nimbus-chunks" directory under os.TempDir().
+func WithChunkDir(dir string) Option {
+	return func(n *NimbusHTTPFormImpl) {
+		n.chunkDir = dir
+	}
+}
+
+// WithFileTTL makes uploaded files expire: a background janitor goroutine
+// periodically deletes objects older than ttl from storage. It also serves
+// as the default expiry duration for the signed URLs returned by Upload
+// when WithSigningSecret is set.
+func WithFileTTL(ttl time.Duration) Option {
+	return func(n *NimbusHTTPFormImpl) {
+		n.fileTTL = ttl
+	}
+}
+
+// WithSigningSecret enables signed download URLs: Upload returns a URL
+// containing an HMAC signature over the stored filename and an expiry, and
+// Download rejects requests whose signature is missing, invalid or expired.
+// Without this option, Download imposes no such requirement, so knowing any
+// stored filename is enough to download it.
+func WithSigningSecret(secret []byte) Option {
+	return func(n *NimbusHTTPFormImpl) {
+		n.signingSecret = secret
+	}
 }
 
 // NNewHTTPFormImpl creates and returns the form implementation of NimbusHTTP.
 // The `dfk` argument is the "default file key" which is a string indicating
 // the name of the file field in requests to be received. `maxSize` specifies
 // the maximum supported file size and `buffSize` indicates the copy buffer
-// size. `tmpDir` is the directory in which the uploaded files will be stored
-// as temporary files. `exts` is a slice containing the extensions which should
-// be permitted. `allowNoExt` specifies whether files without extensions should
-// be handled.
-func NewHTTPFormImpl(dfk string, maxSize, buffSize int64, tmpDir string,
-	exts []string, allowNoExt bool) (NimbusHTTP, error) {
-	// create tmpdir if it doesn't already exist
-	_ = os.Mkdir(tmpDir, 0755)
-	return &NimbusHTTPFormImpl{
+// size. `storage` is the backend uploaded files are persisted to and read
+// back from (see NewLocalStorage, NewMemStorage, NewS3Storage). `exts` is a
+// slice containing the extensions which should be permitted. `allowNoExt`
+// specifies whether files without extensions should be handled. `opts`
+// configures optional behavior; see the Option docs.
+func NewHTTPFormImpl(dfk string, maxSize, buffSize int64, storage Storage,
+	exts []string, allowNoExt bool, opts ...Option) (NimbusHTTP, error) {
+	n := &NimbusHTTPFormImpl{
 		maxSize:           maxSize,
 		tBuffSize:         buffSize,
 		dfk:               dfk,
 		mimeCache:         make(map[string][]string),
-		tmpDir:            tmpDir,
+		storage:           storage,
 		allowedExtensions: exts,
 		allowNoExt:        allowNoExt,
-	}, nil
+		chunks:            make(map[string]*chunkUpload),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	if n.fileTTL > 0 {
+		n.janitorStop = make(chan struct{})
+		go n.runJanitor(n.janitorStop)
+	}
+	n.chunkJanitorStop = make(chan struct{})
+	go n.runChunkJanitor(n.chunkJanitorStop)
+	return n, nil
 }
 
 func (n *NimbusHTTPFormImpl) Cleanup() {
-	// delete tmpdir (and all contents) created during initialization
-	_ = os.RemoveAll(n.tmpDir)
-}
-
-// get path to saved file with given name
-func (n *NimbusHTTPFormImpl) tmpFilePath(name string) string {
-	// no need to acquire mutex since `tmpDir` never changes
-	return fmt.Sprintf("%s/%s", n.tmpDir, path.Base(name))
+	if n.janitorStop != nil {
+		close(n.janitorStop)
+	}
+	close(n.chunkJanitorStop)
+	n.sweepStaleChunks()
+	// delete every object the storage backend is currently holding
+	objs, err := n.storage.List()
+	if err != nil {
+		return
+	}
+	for _, o := range objs {
+		_ = n.storage.Delete(o.Name)
+	}
 }
 
 // isExtAllowed checks whether the extension provided is allowed to be handled
@@ -108,18 +179,18 @@ func (n *NimbusHTTPFormImpl) isExtAllowed(ext string) error {
 	}
 }
 
-// write is a helper which writes the contents of the file `f` to the writer `w`
-// in chunks of `buffSize`.
-func write(f multipart.File, w io.Writer, buffSize int64) error {
+// write is a helper which writes the contents of the reader `r` to the
+// writer `w` in chunks of `buffSize`.
+func write(r io.Reader, w io.Writer, buffSize int64) error {
 	buff := make([]byte, buffSize)
 	for {
-		n, err := f.Read(buff)
+		n, err := r.Read(buff)
 		if err == io.EOF && n == 0 {
 			break
 		} else if err != nil {
 			return err
 		}
-		w.Write(buff)
+		w.Write(buff[:n])
 	}
 	return nil
 }
@@ -129,6 +200,21 @@ type downloadedFile struct {
 	contentType []string
 }
 
+// storeUpload enforces the extension policy for `ext`, cross-checks the
+// content-sniffed MIME type against it when WithAllowedMIMEs is configured, and
+// if both checks pass, copies `r` into storage, generating a unique name
+// from `ext`.
+func (n *NimbusHTTPFormImpl) storeUpload(ext string, r io.Reader) (*ObjectInfo, error) {
+	if err := n.isExtAllowed(ext); err != nil {
+		return nil, err
+	}
+	sniffed, err := sniffMIME(ext, r, n.allowedMIMEs)
+	if err != nil {
+		return nil, err
+	}
+	return n.storage.Put(fmt.Sprintf("*%s", ext), sniffed)
+}
+
 func (n *NimbusHTTPFormImpl) downloadFromRequest(r *http.Request, fileKey string) (*downloadedFile, error) {
 	uploaded, hdr, err := r.FormFile(fileKey)
 	if err != nil {
@@ -136,26 +222,12 @@ func (n *NimbusHTTPFormImpl) downloadFromRequest(r *http.Request, fileKey string
 	}
 	defer uploaded.Close()
 
-	fExt := filepath.Ext(hdr.Filename)
-	if err := n.isExtAllowed(fExt); err != nil {
-		return nil, err
-	}
-
-	n.mu.RLock()
-	tempFile, err := ioutil.TempFile(n.tmpDir, fmt.Sprintf("*%s", fExt))
-	n.mu.RUnlock()
+	info, err := n.storeUpload(filepath.Ext(hdr.Filename), uploaded)
 	if err != nil {
 		return nil, err
 	}
-	defer tempFile.Close()
-
-	// read file into transfer buffer and write in chunks to avoid reading the
-	// whole file at once
-	if err := write(uploaded, tempFile, n.tBuffSize); err != nil {
-		return nil, err
-	}
 	return &downloadedFile{
-		name:        tempFile.Name(),
+		name:        info.Name,
 		contentType: hdr.Header["Content-Type"],
 	}, nil
 }
@@ -171,30 +243,59 @@ func (n *NimbusHTTPFormImpl) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if downloadedFile, err := n.downloadFromRequest(r, n.dfk); err != nil {
+		if isMIMEMismatch(err) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
 		// cache hdr for this file so that it can be downloaded with the same hdr
 		n.mu.Lock()
 		n.mimeCache[downloadedFile.name] = downloadedFile.contentType
 		n.mu.Unlock()
-		w.Write([]byte(path.Base(downloadedFile.name)))
+		if n.signingSecret != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Stored string `json:"stored"`
+				URL    string `json:"url"`
+			}{downloadedFile.name, n.signedDownloadURL(downloadedFile.name)})
+			return
+		}
+		w.Write([]byte(downloadedFile.name))
 	}
 }
 
 // Download defines the endpoint which writes the first requested file from the
-// request queries under the specified "default file key" to the user.
+// request queries under the specified "default file key" to the user. If
+// WithSigningSecret was configured, the request must also carry a valid,
+// unexpired signature (see signedDownloadURL).
 func (n *NimbusHTTPFormImpl) Download(w http.ResponseWriter, r *http.Request) {
 	files := r.URL.Query()[n.dfk]
 	if len(files) == 0 {
 		http.Error(w, "expected file name", http.StatusBadRequest)
 		return
 	}
-	fName := n.tmpFilePath(files[0])
-	f, err := os.Open(fName)
+	if n.signingSecret != nil {
+		if err := n.verifySignedDownload(files[0], r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if n.imageProcessor != nil && isImageExt(filepath.Ext(files[0])) {
+		if tr, ok, err := parseImageTransform(r.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if ok {
+			n.downloadTransformed(w, files[0], tr)
+			return
+		}
+	}
+	f, err := n.storage.Get(files[0])
 	if err != nil {
-		http.Error(w, fmt.Sprintf("cannot open: %s", path.Base(fName)), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("cannot open: %s", files[0]), http.StatusBadRequest)
 		return
 	}
+	defer f.Close()
 	// set headers as they were when the file was uploaded (obtain mu for reading)
 	n.mu.RLock()
 	for _, t := range n.mimeCache[files[0]] {
@@ -202,23 +303,135 @@ func (n *NimbusHTTPFormImpl) Download(w http.ResponseWriter, r *http.Request) {
 	}
 	n.mu.RUnlock()
 	if err := write(f, w, n.tBuffSize); err != nil {
-		http.Error(w, fmt.Sprintf("cannot write: %s", path.Base(fName)), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("cannot write: %s", files[0]), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (n *NimbusHTTPFormImpl) UploadMany(w http.ResponseWriter, _ *http.Request) {
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+// downloadTransformed serves an image transform of the stored file `name`,
+// applying it and populating the derived-image cache under tr.cacheKey(name)
+// on a cache miss.
+func (n *NimbusHTTPFormImpl) downloadTransformed(w http.ResponseWriter, name string, tr *imageTransform) {
+	cacheKey := tr.cacheKey(name)
+	contentType := imageContentTypes[tr.targetExt(name)]
+
+	if cached, err := n.storage.Get(cacheKey); err == nil {
+		defer cached.Close()
+		w.Header().Set("Content-Type", contentType)
+		_ = write(cached, w, n.tBuffSize)
+		return
+	}
+
+	src, err := n.storage.Get(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot open: %s", name), http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(src)
+	src.Close()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot read: %s", name), http.StatusInternalServerError)
+		return
+	}
+
+	transformed, err := n.imageProcessor.apply(tr, name, data)
+	if err != nil {
+		if isDimensionError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := n.storage.PutAt(cacheKey, bytes.NewReader(transformed)); err != nil {
+		log.Printf("failed to cache image transform %s: %s", cacheKey, err.Error())
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(transformed)
+}
+
+// uploadResult reports the outcome of storing a single file as part of an
+// UploadMany request, in the style of the jQuery-File-Upload response
+// convention, so existing frontends built against that convention can
+// integrate against it.
+type uploadResult struct {
+	Original    string `json:"original"`
+	Stored      string `json:"stored"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	Error       string `json:"error"`
+}
+
+// UploadMany accepts any number of files under the "default file key" in a
+// single multipart request and stores each one independently, so that one
+// bad file doesn't fail the whole batch. It reads directly off the
+// multipart.Reader, rather than calling ParseMultipartForm, to avoid
+// buffering every part to disk before processing it.
+func (n *NimbusHTTPFormImpl) UploadMany(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, n.maxSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	// Initialized rather than left nil so an empty or unrelated multipart
+	// request still serializes as "files": [] below, not null - jQuery
+	// File Upload-style clients expect an array to iterate.
+	results := make([]uploadResult, 0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, "error parsing form", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != n.dfk || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		result := uploadResult{Original: part.FileName()}
+		info, err := n.storeUpload(filepath.Ext(part.FileName()), part)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			contentType := part.Header.Get("Content-Type")
+			n.mu.Lock()
+			n.mimeCache[info.Name] = part.Header["Content-Type"]
+			n.mu.Unlock()
+			result.Stored = info.Name
+			result.Size = info.Size
+			result.ContentType = contentType
+		}
+		part.Close()
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Files []uploadResult `json:"files"`
+	}{results})
 }
 
 // DownloadMany decodes a JSON body from the response with a string[] in the
-// `filenames` field which specifies which files to archive and download.
-// A zip archive is returned when all specified files exist and the archiving
-// process does not encounter any errors. Otherwise, the encountered error is
-// reported.
+// `filenames` field which specifies which files to archive and download. If
+// WithSigningSecret was configured, the body must also carry parallel
+// `expires`/`sigs` arrays (see signedDownloadURL), one signature per
+// filename, and the whole batch is rejected if any one of them is missing,
+// expired or invalid.
+// The archive is streamed directly to the response as it is built, rather
+// than being buffered in memory first, so large sets of files don't blow up
+// server memory. Because of this, once the first byte has been written, a
+// failure partway through can only be logged - the response status has
+// already been committed.
 func (n *NimbusHTTPFormImpl) DownloadMany(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Filenames []string `json:"filenames"`
+		Expires   []int64  `json:"expires"`
+		Sigs      []string `json:"sigs"`
 	}
 	// decode filenames
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -226,25 +439,39 @@ func (n *NimbusHTTPFormImpl) DownloadMany(w http.ResponseWriter, r *http.Request
 		http.Error(w, "failed to decode request", http.StatusBadRequest)
 		return
 	}
-	// create new zip archive
-	archiveErrStub := "failed to compile archive: "
-	archive := new(bytes.Buffer)
-	archiver := NewZipper(archive)
+	if n.signingSecret != nil {
+		if len(req.Expires) != len(req.Filenames) || len(req.Sigs) != len(req.Filenames) {
+			http.Error(w, "missing signature", http.StatusForbidden)
+			return
+		}
+		for i, filename := range req.Filenames {
+			if err := n.verifySignature(filename, req.Sigs[i], req.Expires[i]); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"archive.zip\"")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	archiver := NewZipper(w)
 	for _, filename := range req.Filenames {
-		// add to zip arhive
-		if err := archiver.AddFile(n.tmpFilePath(filename)); err != nil {
-			http.Error(w, archiveErrStub+err.Error(), http.StatusBadRequest)
+		// add to zip archive, streaming straight from the storage backend
+		f, err := n.storage.Get(filename)
+		if err != nil {
+			log.Printf("failed to compile archive: %s", err.Error())
+			return
+		}
+		err = archiver.AddReader(filename, f)
+		f.Close()
+		if err != nil {
+			log.Printf("failed to compile archive: %s", err.Error())
 			return
 		}
 	}
 	if err := archiver.Close(); err != nil {
-		http.Error(w, archiveErrStub+err.Error(), http.StatusInternalServerError)
-		return
+		log.Printf("failed to compile archive: %s", err.Error())
 	}
-	// write archive to response
-	w.Header().Add("Content-Type", "application/zip")
-	w.Header().Add("Content-Disposition", "attachment; filename=\"archive.zip\"")
-	w.Write(archive.Bytes())
 }
 
 func (n *NimbusHTTPFormImpl) Delete(w http.ResponseWriter, r *http.Request) {
@@ -253,13 +480,11 @@ func (n *NimbusHTTPFormImpl) Delete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "expected file name", http.StatusBadRequest)
 		return
 	}
-	fName := n.tmpFilePath(files[0])
-	err := os.Remove(n.tmpFilePath(fName))
-	if err != nil {
+	if err := n.storage.Delete(files[0]); err != nil {
 		http.Error(w, "failed to delete file: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 	n.mu.Lock()
-	delete(n.mimeCache, path.Base(fName))
+	delete(n.mimeCache, files[0])
 	n.mu.Unlock()
 }
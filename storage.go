@@ -0,0 +1,39 @@
+package nimbus
+
+import (
+	"io"
+	"time"
+)
+
+// ObjectInfo describes metadata about an object held by a Storage backend.
+// ContentType mirrors the header slice nimbus already caches in mimeCache.
+type ObjectInfo struct {
+	Name        string
+	Size        int64
+	ModTime     time.Time
+	ContentType []string
+}
+
+// Storage abstracts the persistence layer used by NimbusHTTPFormImpl so that
+// uploaded files can be backed by local disk, memory or a remote object
+// store interchangeably.
+type Storage interface {
+	// Put stores the contents of r under a name derived from pattern (in the
+	// style of ioutil.TempFile's pattern argument, where a "*" is replaced
+	// with a random/unique string) and returns the resulting object's
+	// metadata.
+	Put(pattern string, r io.Reader) (*ObjectInfo, error)
+	// PutAt stores the contents of r under the exact name given, overwriting
+	// any existing object with that name. This is used for derived data
+	// (e.g. cached image transforms) whose name callers need to predict.
+	PutAt(name string, r io.Reader) (*ObjectInfo, error)
+	// Get opens the named object for reading. Callers must Close the
+	// returned ReadCloser.
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes the named object.
+	Delete(name string) error
+	// Stat returns metadata about the named object without opening it.
+	Stat(name string) (*ObjectInfo, error)
+	// List returns metadata for every object currently held by the backend.
+	List() ([]*ObjectInfo, error)
+}
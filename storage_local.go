@@ -0,0 +1,84 @@
+package nimbus
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// LocalStorage is a Storage implementation which persists objects as files
+// on local disk. This is the backend nimbus used exclusively before Storage
+// was introduced.
+type LocalStorage struct {
+	dir string
+}
+
+// NewLocalStorage creates a LocalStorage rooted at dir, creating dir if it
+// does not already exist.
+func NewLocalStorage(dir string) (*LocalStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{dir: dir}, nil
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.dir, path.Base(name))
+}
+
+func (s *LocalStorage) Put(pattern string, r io.Reader) (*ObjectInfo, error) {
+	f, err := ioutil.TempFile(s.dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return nil, err
+	}
+	return s.Stat(f.Name())
+}
+
+func (s *LocalStorage) PutAt(name string, r io.Reader) (*ObjectInfo, error) {
+	f, err := os.Create(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return nil, err
+	}
+	return s.Stat(name)
+}
+
+func (s *LocalStorage) Get(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *LocalStorage) Stat(name string) (*ObjectInfo, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *LocalStorage) List() ([]*ObjectInfo, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]*ObjectInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		objs = append(objs, &ObjectInfo{Name: e.Name(), Size: e.Size(), ModTime: e.ModTime()})
+	}
+	return objs, nil
+}
@@ -0,0 +1,108 @@
+package nimbus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memObject holds the bytes and metadata of an object stored by MemStorage.
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// MemStorage is an in-memory Storage implementation. It is useful for tests
+// and for short-lived deployments where objects don't need to survive a
+// restart.
+type MemStorage struct {
+	mu      sync.RWMutex
+	objects map[string]memObject
+	seq     uint64
+}
+
+// NewMemStorage creates an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{objects: make(map[string]memObject)}
+}
+
+// genName expands pattern the same way ioutil.TempFile does: a "*" is
+// replaced with a unique suffix, or the suffix is appended if absent.
+func (s *MemStorage) genName(pattern string) string {
+	s.seq++
+	suffix := strconv.FormatUint(s.seq, 36)
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		return pattern[:i] + suffix + pattern[i+1:]
+	}
+	return pattern + suffix
+}
+
+func (s *MemStorage) Put(pattern string, r io.Reader) (*ObjectInfo, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	name := s.genName(pattern)
+	obj := memObject{data: data, modTime: time.Now()}
+	s.objects[name] = obj
+	s.mu.Unlock()
+	return &ObjectInfo{Name: name, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (s *MemStorage) PutAt(name string, r io.Reader) (*ObjectInfo, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	obj := memObject{data: data, modTime: time.Now()}
+	s.mu.Lock()
+	s.objects[name] = obj
+	s.mu.Unlock()
+	return &ObjectInfo{Name: name, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (s *MemStorage) Get(name string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	obj, ok := s.objects[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("object not found: %s", name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (s *MemStorage) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[name]; !ok {
+		return fmt.Errorf("object not found: %s", name)
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *MemStorage) Stat(name string) (*ObjectInfo, error) {
+	s.mu.RLock()
+	obj, ok := s.objects[name]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("object not found: %s", name)
+	}
+	return &ObjectInfo{Name: name, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+func (s *MemStorage) List() ([]*ObjectInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	objs := make([]*ObjectInfo, 0, len(s.objects))
+	for name, obj := range s.objects {
+		objs = append(objs, &ObjectInfo{Name: name, Size: int64(len(obj.data)), ModTime: obj.modTime})
+	}
+	return objs, nil
+}
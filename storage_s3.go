@@ -0,0 +1,138 @@
+package nimbus
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Storage is a Storage implementation backed by an S3-compatible object
+// store (AWS S3, MinIO, etc.), keying objects under prefix within bucket.
+type S3Storage struct {
+	bucket string
+	prefix string
+
+	client     *s3.S3
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+	seq        uint64
+}
+
+// NewS3Storage creates an S3Storage which stores objects in bucket under
+// prefix, using sess for authentication and endpoint configuration. Passing
+// a session configured with a custom Endpoint allows this to target any
+// S3-compatible service (e.g. MinIO).
+func NewS3Storage(sess *session.Session, bucket, prefix string) *S3Storage {
+	return &S3Storage{
+		bucket:     bucket,
+		prefix:     strings.Trim(prefix, "/"),
+		client:     s3.New(sess),
+		uploader:   s3manager.NewUploader(sess),
+		downloader: s3manager.NewDownloader(sess),
+	}
+}
+
+// genName expands pattern the same way ioutil.TempFile does: a "*" is
+// replaced with a unique suffix, or the suffix is appended if absent.
+func (s *S3Storage) genName(pattern string) string {
+	seq := atomic.AddUint64(&s.seq, 1)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatUint(seq, 36)
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		return pattern[:i] + suffix + pattern[i+1:]
+	}
+	return pattern + suffix
+}
+
+func (s *S3Storage) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *S3Storage) Put(pattern string, r io.Reader) (*ObjectInfo, error) {
+	name := s.genName(pattern)
+	if _, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   r,
+	}); err != nil {
+		return nil, err
+	}
+	return s.Stat(name)
+}
+
+func (s *S3Storage) PutAt(name string, r io.Reader) (*ObjectInfo, error) {
+	if _, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   r,
+	}); err != nil {
+		return nil, err
+	}
+	return s.Stat(name)
+}
+
+func (s *S3Storage) Get(name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	return err
+}
+
+func (s *S3Storage) Stat(name string) (*ObjectInfo, error) {
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := &ObjectInfo{Name: name, Size: aws.Int64Value(out.ContentLength)}
+	if out.LastModified != nil {
+		info.ModTime = *out.LastModified
+	}
+	if out.ContentType != nil {
+		info.ContentType = []string{*out.ContentType}
+	}
+	return info, nil
+}
+
+func (s *S3Storage) List() ([]*ObjectInfo, error) {
+	var objs []*ObjectInfo
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket)}
+	if s.prefix != "" {
+		input.Prefix = aws.String(s.prefix + "/")
+	}
+	err := s.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(obj.Key), s.prefix+"/")
+			info := &ObjectInfo{Name: name, Size: aws.Int64Value(obj.Size)}
+			if obj.LastModified != nil {
+				info.ModTime = *obj.LastModified
+			}
+			objs = append(objs, info)
+		}
+		return true
+	})
+	return objs, err
+}
@@ -23,12 +23,20 @@ func (z *Zipper) AddFile(filename string) error {
 		return err
 	}
 	defer f.Close()
-	if writer, err := z.z.Create(path.Base(filename)); err != nil {
-		return err
-	} else {
-		_, err := io.Copy(writer, f)
+	return z.AddReader(path.Base(filename), f)
+}
+
+// AddReader adds an entry named `name` to the archive, copying its contents
+// from `r`. This allows callers to add entries whose contents come from
+// anywhere a Storage backend can produce an io.Reader, rather than only
+// files which exist on local disk.
+func (z *Zipper) AddReader(name string, r io.Reader) error {
+	writer, err := z.z.Create(name)
+	if err != nil {
 		return err
 	}
+	_, err = io.Copy(writer, r)
+	return err
 }
 
 func (z *Zipper) Close() error {